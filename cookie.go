@@ -0,0 +1,73 @@
+// Copyright (C) 2015 Audrius Butkevicius and Contributors (see the CONTRIBUTORS file).
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Anti-spoofing cookie handling. When enabled via -require-cookie, the
+// first announce from a source IP we haven't seen before is answered
+// with a cookieMagic challenge instead of being stored. The announcement
+// is only committed once the client re-announces with the cookie echoed
+// back, wrapped in a cookieAnnounceMagic packet.
+const (
+	cookieMagic         uint32 = 0x434f4f4b // "COOK"
+	cookieAnnounceMagic uint32 = 0x434f4b41 // "COKA"
+
+	cookieHMACSize = 16
+	cookieTSSize   = 8
+	cookieWireSize = cookieTSSize + cookieHMACSize
+
+	cookieMaxAge = 60 * time.Second
+)
+
+var cookieSecret [32]byte
+
+func init() {
+	if _, err := rand.Read(cookieSecret[:]); err != nil {
+		panic(err)
+	}
+}
+
+// newCookieChallenge builds a cookieMagic packet challenging the sender at
+// ip to prove it can receive UDP traffic on the IP it announced from.
+func newCookieChallenge(ip net.IP) []byte {
+	ts := time.Now().Unix()
+
+	buf := make([]byte, 4+cookieWireSize)
+	binary.BigEndian.PutUint32(buf, cookieMagic)
+	binary.BigEndian.PutUint64(buf[4:], uint64(ts))
+	copy(buf[4+cookieTSSize:], cookieHMAC(ip, ts))
+	return buf
+}
+
+// verifyCookie checks a cookieWireSize-byte cookie (timestamp followed by
+// its HMAC) against ip, rejecting cookies that are too old to guard
+// against replay.
+func verifyCookie(ip net.IP, cookie []byte) bool {
+	if len(cookie) != cookieWireSize {
+		return false
+	}
+
+	ts := int64(binary.BigEndian.Uint64(cookie[:cookieTSSize]))
+	if age := time.Since(time.Unix(ts, 0)); age < 0 || age > cookieMaxAge {
+		return false
+	}
+
+	return hmac.Equal(cookieHMAC(ip, ts), cookie[cookieTSSize:])
+}
+
+func cookieHMAC(ip net.IP, ts int64) []byte {
+	mac := hmac.New(sha256.New, cookieSecret[:])
+	mac.Write(ip)
+	var tsb [cookieTSSize]byte
+	binary.BigEndian.PutUint64(tsb[:], uint64(ts))
+	mac.Write(tsb[:])
+	return mac.Sum(nil)[:cookieHMACSize]
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/lib/discover"
+)
+
+// jsonRelay and jsonAnnounce mirror the fields of discover.Relay and
+// discover.Announce that are meaningful to REST clients.
+type jsonRelay struct {
+	Address string `json:"address"`
+	Latency int32  `json:"latency"`
+}
+
+type jsonAnnounce struct {
+	Addresses []string    `json:"addresses"`
+	Relays    []jsonRelay `json:"relays,omitempty"`
+}
+
+// serveHTTP starts the HTTPS v2 discovery frontend, sharing the store
+// with the UDP frontend. The client's device ID is taken from the
+// certificate it presents during the TLS handshake.
+func serveHTTP(listen, certFile, keyFile string, store Store, unknownLog io.Writer) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequestClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		switch r.Method {
+		case http.MethodPost:
+			err = handleAnnounceHTTP(store, w, r)
+		case http.MethodGet:
+			err = handleQueryHTTP(store, w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil && unknownLog != nil {
+			fmt.Fprintf(unknownLog, "HE %d %v %v\n", time.Now().Unix(), r.RemoteAddr, err)
+		}
+	})
+
+	srv := &http.Server{
+		Addr:      listen,
+		Handler:   mux,
+		TLSConfig: cfg,
+	}
+	return srv.ListenAndServeTLS("", "")
+}
+
+func handleAnnounceHTTP(store Store, w http.ResponseWriter, r *http.Request) error {
+	if len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "Client certificate required", http.StatusUnauthorized)
+		return fmt.Errorf("no client certificate")
+	}
+	id := protocol.NewDeviceID(r.TLS.PeerCertificates[0].Raw)
+
+	var ann jsonAnnounce
+	if err := json.NewDecoder(r.Body).Decode(&ann); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return err
+	}
+
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+
+	var addrs []address
+	now := time.Now().Unix()
+	for _, addr := range ann.Addresses {
+		uri, err := url.Parse(addr)
+		if err != nil {
+			continue
+		}
+		host, port, err := net.SplitHostPort(uri.Host)
+		if err != nil {
+			continue
+		}
+		if len(host) == 0 {
+			uri.Host = net.JoinHostPort(remoteIP, port)
+		}
+		addrs = append(addrs, address{
+			address: uri.String(),
+			seen:    now,
+		})
+	}
+
+	relays := make([]discover.Relay, len(ann.Relays))
+	for i, rl := range ann.Relays {
+		relays[i] = discover.Relay{Address: rl.Address, Latency: rl.Latency}
+	}
+
+	if err := store.Update(id, addrs, relays); err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func handleQueryHTTP(store Store, w http.ResponseWriter, r *http.Request) error {
+	deviceParam := r.URL.Query().Get("device")
+	id, err := protocol.DeviceIDFromString(deviceParam)
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return err
+	}
+
+	addrs, relays, err := store.Get(id)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return err
+	}
+
+	now := time.Now().Unix()
+	resp := jsonAnnounce{}
+	for _, addr := range addrs {
+		if now-addr.seen > cacheLimitSeconds {
+			continue
+		}
+		resp.Addresses = append(resp.Addresses, addr.address)
+	}
+	for _, rl := range relays {
+		resp.Relays = append(resp.Relays, jsonRelay{Address: rl.address, Latency: rl.latency})
+	}
+
+	if len(resp.Addresses) == 0 {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,88 @@
+// Copyright (C) 2015 Audrius Butkevicius and Contributors (see the CONTRIBUTORS file).
+
+// Package logger implements a small leveled logger, with debug output
+// gated per facet by the STTRACE environment variable.
+package logger
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Logger wraps the standard log.Logger with Info/Warn/Fatal levels and
+// facet-gated Debug output.
+type Logger struct {
+	*log.Logger
+}
+
+// New returns a Logger writing to stdout with the standard library's
+// default flags.
+func New() *Logger {
+	return &Logger{log.New(os.Stdout, "", log.LstdFlags)}
+}
+
+func (l *Logger) Debugln(facet string, vals ...interface{}) {
+	if !IsDebug(facet) {
+		return
+	}
+	l.Output(2, "DEBUG ("+facet+"): "+fmt.Sprintln(vals...))
+}
+
+func (l *Logger) Debugf(facet, format string, vals ...interface{}) {
+	if !IsDebug(facet) {
+		return
+	}
+	l.Output(2, "DEBUG ("+facet+"): "+fmt.Sprintf(format, vals...))
+}
+
+func (l *Logger) Infoln(vals ...interface{}) {
+	l.Output(2, "INFO: "+fmt.Sprintln(vals...))
+}
+
+func (l *Logger) Infof(format string, vals ...interface{}) {
+	l.Output(2, "INFO: "+fmt.Sprintf(format, vals...))
+}
+
+func (l *Logger) Warnln(vals ...interface{}) {
+	l.Output(2, "WARNING: "+fmt.Sprintln(vals...))
+}
+
+func (l *Logger) Warnf(format string, vals ...interface{}) {
+	l.Output(2, "WARNING: "+fmt.Sprintf(format, vals...))
+}
+
+func (l *Logger) Fatalln(vals ...interface{}) {
+	l.Output(2, "FATAL: "+fmt.Sprintln(vals...))
+	os.Exit(1)
+}
+
+func (l *Logger) Fatalf(format string, vals ...interface{}) {
+	l.Output(2, "FATAL: "+fmt.Sprintf(format, vals...))
+	os.Exit(1)
+}
+
+// facets holds the set of debug facets enabled via STTRACE, parsed once
+// at startup. STTRACE is a comma separated list of facet names, or "all"
+// to enable every facet.
+var facets = parseTrace(os.Getenv("STTRACE"))
+
+func parseTrace(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, facet := range strings.Split(s, ",") {
+		facet = strings.TrimSpace(facet)
+		if facet != "" {
+			m[facet] = true
+		}
+	}
+	return m
+}
+
+// IsDebug reports whether debug logging is enabled for the given facet.
+// Callers on hot paths should cache the result in a package level bool
+// rather than calling this on every iteration, as STTRACE never changes
+// after startup.
+func IsDebug(facet string) bool {
+	return facets["all"] || facets[facet]
+}
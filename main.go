@@ -7,8 +7,8 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -17,92 +17,168 @@ import (
 
 	"github.com/golang/groupcache/lru"
 	"github.com/juju/ratelimit"
+	"github.com/syncthing/discosrv/logger"
+	"github.com/syncthing/discosrv/metrics"
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/lib/discover"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
 const cacheLimitSeconds = 3600
 
 var (
-	lock       sync.Mutex
-	queries    = 0
-	announces  = 0
-	answered   = 0
-	limited    = 0
-	unknowns   = 0
-	debug      = false
-	lruSize    = 1024
-	limitAvg   = 1
-	limitBurst = 10
-	limiter    *lru.Cache
+	l = logger.New()
+
+	lock          sync.Mutex
+	lruSize       = 1024
+	limitAvg      = 1
+	limitBurst    = 10
+	limiter       *lru.Cache
+	requireCookie = false
+	cookieLRU     *lru.Cache
+
+	// Cached once at startup so the UDP hot path checks a bool instead of
+	// doing an IsDebug map lookup per datagram.
+	debugNet   = logger.IsDebug("net")
+	debugLimit = logger.IsDebug("limit")
+	debugProto = logger.IsDebug("proto")
 )
 
 func main() {
 	var listen string
+	var httpListen string
+	var metricsListen string
+	var certFile string
+	var keyFile string
 	var timestamp bool
 	var statsIntv int
 	var statsFile string
+	var statsMaxSize int64
+	var statsMaxAge time.Duration
 	var unknownFile string
+	var unknownMaxSize int64
 	var dbDir string
-
-	flag.StringVar(&listen, "listen", ":22027", "Listen address")
-	flag.BoolVar(&debug, "debug", false, "Enable debug output")
+	var dbBackend string
+	var dbDSN string
+	var addressMaxAge time.Duration
+	var deviceMaxAge time.Duration
+
+	flag.StringVar(&listen, "listen", ":22027", "UDP listen address")
+	flag.StringVar(&httpListen, "http-listen", "", "HTTPS listen address (disabled if empty)")
+	flag.StringVar(&metricsListen, "metrics-listen", "", "Prometheus metrics listen address (disabled if empty)")
+	flag.StringVar(&certFile, "cert", "cert.pem", "HTTPS certificate file")
+	flag.StringVar(&keyFile, "key", "key.pem", "HTTPS key file")
 	flag.BoolVar(&timestamp, "timestamp", true, "Timestamp the log output")
 	flag.IntVar(&statsIntv, "stats-intv", 0, "Statistics output interval (s)")
 	flag.StringVar(&statsFile, "stats-file", "/var/discosrv/stats", "Statistics file name")
+	flag.Int64Var(&statsMaxSize, "stats-max-size", 0, "Rotate the statistics file above this size, in bytes (disabled if zero)")
+	flag.DurationVar(&statsMaxAge, "stats-max-age", 0, "Rotate the statistics file after this age (disabled if zero)")
 	flag.StringVar(&unknownFile, "unknown-file", "", "Unknown packet log file name")
+	flag.Int64Var(&unknownMaxSize, "unknown-max-size", 0, "Rotate the unknown packet log above this size, in bytes (disabled if zero)")
 	flag.IntVar(&lruSize, "limit-cache", lruSize, "Limiter cache entries")
 	flag.IntVar(&limitAvg, "limit-avg", limitAvg, "Allowed average package rate, per 10 s")
 	flag.IntVar(&limitBurst, "limit-burst", limitBurst, "Allowed burst size, packets")
-	flag.StringVar(&dbDir, "db-dir", "/var/discosrv/db", "Database directory")
+	flag.BoolVar(&requireCookie, "require-cookie", requireCookie, "Require a cookie challenge/response before storing an announce from a new source IP")
+	flag.StringVar(&dbDir, "db-dir", "/var/discosrv/db", "Database directory (leveldb backend only)")
+	flag.StringVar(&dbBackend, "db-backend", "leveldb", "Database backend (leveldb, ql, postgres)")
+	flag.StringVar(&dbDSN, "db-dsn", os.Getenv("DISCOSRV_DB_DSN"), "Database DSN (ql, postgres backends; overrides DISCOSRV_DB_DSN)")
+	flag.DurationVar(&addressMaxAge, "address-max-age", 2*time.Hour, "Retention window for addresses and relays (ql, postgres backends)")
+	flag.DurationVar(&deviceMaxAge, "device-max-age", 24*time.Hour, "Retention window for devices with no recent addresses (ql, postgres backends)")
 	flag.Parse()
 
 	limiter = lru.New(lruSize)
+	cookieLRU = lru.New(lruSize)
 
-	log.SetOutput(os.Stdout)
 	if !timestamp {
-		log.SetFlags(0)
+		l.SetFlags(0)
 	}
 
 	addr, _ := net.ResolveUDPAddr("udp", listen)
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		log.Fatal(err)
+		l.Fatalln(err)
 	}
 
-	parentDir := filepath.Dir(dbDir)
-	if _, err := os.Stat(parentDir); err != nil && os.IsNotExist(err) {
-		err = os.MkdirAll(parentDir, 0755)
-		if err != nil {
-			log.Fatal(err)
+	var store Store
+	if dbBackend == "leveldb" {
+		parentDir := filepath.Dir(dbDir)
+		if _, err := os.Stat(parentDir); err != nil && os.IsNotExist(err) {
+			err = os.MkdirAll(parentDir, 0755)
+			if err != nil {
+				l.Fatalln(err)
+			}
 		}
+		store, err = newLeveldbStore(dbDir)
+	} else {
+		store, err = newSQLStore(dbBackend, dbDSN, addressMaxAge, deviceMaxAge)
 	}
-
-	db, err := leveldb.OpenFile(dbDir, &opt.Options{OpenFilesCacheCapacity: 32})
 	if err != nil {
-		log.Fatal(err)
+		l.Fatalln(err)
 	}
 
-	statsLog, err := os.OpenFile(statsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	statsLog, err := newRotator(statsFile, statsMaxSize)
 	if err != nil {
-		log.Fatal(err)
+		l.Fatalln(err)
+	}
+	if statsMaxAge > 0 {
+		go watchRotateAge(statsLog, statsMaxAge)
 	}
 
 	var unknownLog io.Writer
 	if unknownFile != "" {
-		unknownLog, err = os.OpenFile(unknownFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		unknownRotator, err := newRotator(unknownFile, unknownMaxSize)
 		if err != nil {
-			log.Fatal(err)
+			l.Fatalln(err)
 		}
+		unknownLog = unknownRotator
 	}
 
 	if statsIntv > 0 {
 		go logStats(statsLog, statsIntv)
 	}
 
-	go clean(statsLog, db)
+	go clean(statsLog, store)
+
+	if httpListen != "" {
+		go func() {
+			if err := serveHTTP(httpListen, certFile, keyFile, store, unknownLog); err != nil {
+				l.Fatalln(err)
+			}
+		}()
+	}
+
+	if metricsListen != "" {
+		metrics.RegisterGauge("discosrv_limiter_entries", func() float64 {
+			lock.Lock()
+			defer lock.Unlock()
+			return float64(limiter.Len())
+		})
+		metrics.RegisterGauge("discosrv_devices", func() float64 {
+			devices, _, _, err := cachedCounts(store)
+			if err != nil {
+				return 0
+			}
+			return float64(devices)
+		})
+		metrics.RegisterGauge("discosrv_addresses", func() float64 {
+			_, addresses, _, err := cachedCounts(store)
+			if err != nil {
+				return 0
+			}
+			return float64(addresses)
+		})
+		metrics.RegisterGauge("discosrv_relays", func() float64 {
+			_, _, relays, err := cachedCounts(store)
+			if err != nil {
+				return 0
+			}
+			return float64(relays)
+		})
+		go func() {
+			if err := http.ListenAndServe(metricsListen, metrics.Handler()); err != nil {
+				l.Fatalln(err)
+			}
+		}()
+	}
 
 	var buf = make([]byte, 1024)
 	for {
@@ -115,11 +191,13 @@ func main() {
 		}
 
 		if err != nil {
-			log.Fatal(err)
+			l.Fatalln(err)
 		}
 
 		if n < 4 {
-			log.Printf("Received short packet (%d bytes)", n)
+			if debugNet {
+				l.Debugln("net", "Received short packet", n, "bytes")
+			}
 			continue
 		}
 
@@ -128,21 +206,25 @@ func main() {
 
 		switch magic {
 		case discover.AnnouncementMagic:
-			err := handleAnnounceV2(db, addr, buf)
+			err := handleAnnounceV2(store, conn, addr, buf, false)
+			if err != nil && unknownLog != nil {
+				fmt.Fprintf(unknownLog, "AE %d %v %x\n", time.Now().Unix(), addr, buf)
+			}
+
+		case cookieAnnounceMagic:
+			err := handleAnnounceV2(store, conn, addr, buf, true)
 			if err != nil && unknownLog != nil {
 				fmt.Fprintf(unknownLog, "AE %d %v %x\n", time.Now().Unix(), addr, buf)
 			}
 
 		case discover.QueryMagic:
-			err := handleQueryV2(db, conn, addr, buf)
+			err := handleQueryV2(store, conn, addr, buf)
 			if err != nil && unknownLog != nil {
 				fmt.Fprintf(unknownLog, "QE %d %v %x\n", time.Now().Unix(), addr, buf)
 			}
 
 		default:
-			lock.Lock()
-			unknowns++
-			lock.Unlock()
+			metrics.IncUnknowns()
 			if unknownLog != nil {
 				fmt.Fprintf(unknownLog, "UN %d %v %x\n", time.Now().Unix(), addr, buf)
 			}
@@ -150,6 +232,31 @@ func main() {
 	}
 }
 
+// countsCacheTTL bounds how often a metrics scrape triggers a fresh
+// store.Counts() call; the three count gauges share the cached result so a
+// single scrape doesn't run the underlying query (or, for leveldb, a full
+// database scan) three times over.
+const countsCacheTTL = time.Second
+
+var (
+	countsMut  sync.Mutex
+	countsAt   time.Time
+	countsErr  error
+	countsVals [3]int64
+)
+
+func cachedCounts(store Store) (devices, addresses, relays int64, err error) {
+	countsMut.Lock()
+	defer countsMut.Unlock()
+
+	if time.Since(countsAt) > countsCacheTTL {
+		countsVals[0], countsVals[1], countsVals[2], countsErr = store.Counts()
+		countsAt = time.Now()
+	}
+
+	return countsVals[0], countsVals[1], countsVals[2], countsErr
+}
+
 func limit(addr *net.UDPAddr) bool {
 	key := addr.IP.String()
 
@@ -161,15 +268,15 @@ func limit(addr *net.UDPAddr) bool {
 		bkt := bkt.(*ratelimit.Bucket)
 		if bkt.TakeAvailable(1) != 1 {
 			// Rate limit exceeded; ignore packet
-			if debug {
-				log.Println("Rate limit exceeded for", key)
+			if debugLimit {
+				l.Debugln("limit", "Rate limit exceeded for", key)
 			}
-			limited++
+			metrics.IncLimited()
 			return true
 		}
 	} else {
-		if debug {
-			log.Println("New limiter for", key)
+		if debugLimit {
+			l.Debugln("limit", "New limiter for", key)
 		}
 		// One packet per ten seconds average rate, burst ten packets
 		limiter.Add(key, ratelimit.NewBucket(10*time.Second/time.Duration(limitAvg), int64(limitBurst)))
@@ -178,24 +285,44 @@ func limit(addr *net.UDPAddr) bool {
 	return false
 }
 
-func handleAnnounceV2(db *leveldb.DB, addr *net.UDPAddr, buf []byte) error {
+func handleAnnounceV2(store Store, conn *net.UDPConn, addr *net.UDPAddr, buf []byte, hasCookie bool) error {
+	t0 := time.Now()
+	defer func() { metrics.AnnounceLatency.Observe(time.Since(t0)) }()
+
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+
+	if hasCookie {
+		if len(buf) < 4+cookieWireSize {
+			return fmt.Errorf("short cookie announce packet")
+		}
+		if !verifyCookie(ip, buf[4:4+cookieWireSize]) {
+			return fmt.Errorf("invalid cookie from %v", addr)
+		}
+		cookieLRU.Add(ip.String(), true)
+		buf = buf[4+cookieWireSize:]
+	} else if requireCookie {
+		if verified, _ := cookieLRU.Get(ip.String()); verified != true {
+			if debugProto {
+				l.Debugln("proto", "Challenging unverified source", ip)
+			}
+			conn.WriteToUDP(newCookieChallenge(ip), addr)
+			return nil
+		}
+	}
+
 	var pkt discover.Announce
 	err := pkt.UnmarshalXDR(buf)
 	if err != nil && err != io.EOF {
 		return err
 	}
-	if debug {
-		log.Printf("<- %v %#v", addr, pkt)
+	if debugProto {
+		l.Debugf("proto", "<- %v %#v", addr, pkt)
 	}
 
-	lock.Lock()
-	announces++
-	lock.Unlock()
-
-	ip := addr.IP.To4()
-	if ip == nil {
-		ip = addr.IP.To16()
-	}
+	metrics.IncAnnounces()
 
 	var addrs []address
 	now := time.Now().Unix()
@@ -230,18 +357,20 @@ func handleAnnounceV2(db *leveldb.DB, addr *net.UDPAddr, buf []byte) error {
 		}
 	}
 
-	update(db, id, addrs, pkt.This.Relays)
-	return nil
+	return store.Update(id, addrs, pkt.This.Relays)
 }
 
-func handleQueryV2(db *leveldb.DB, conn *net.UDPConn, addr *net.UDPAddr, buf []byte) error {
+func handleQueryV2(store Store, conn *net.UDPConn, addr *net.UDPAddr, buf []byte) error {
+	t0 := time.Now()
+	defer func() { metrics.QueryLatency.Observe(time.Since(t0)) }()
+
 	var pkt discover.Query
 	err := pkt.UnmarshalXDR(buf)
 	if err != nil {
 		return err
 	}
-	if debug {
-		log.Printf("<- %v %#v", addr, pkt)
+	if debugProto {
+		l.Debugf("proto", "<- %v %#v", addr, pkt)
 	}
 
 	var id protocol.DeviceID
@@ -255,11 +384,12 @@ func handleQueryV2(db *leveldb.DB, conn *net.UDPConn, addr *net.UDPAddr, buf []b
 		}
 	}
 
-	lock.Lock()
-	queries++
-	lock.Unlock()
+	metrics.IncQueries()
 
-	addrs, relays := get(db, id)
+	addrs, relays, err := store.Get(id)
+	if err != nil {
+		return err
+	}
 
 	drelays := make([]discover.Relay, 0, len(relays))
 	for _, relay := range relays {
@@ -284,8 +414,8 @@ func handleQueryV2(db *leveldb.DB, conn *net.UDPConn, addr *net.UDPAddr, buf []b
 			}
 			ann.This.Addresses = append(ann.This.Addresses, addr.address)
 		}
-		if debug {
-			log.Printf("-> %v %#v", addr, pkt)
+		if debugProto {
+			l.Debugf("proto", "-> %v %#v", addr, pkt)
 		}
 
 		if len(ann.This.Addresses) == 0 {
@@ -294,18 +424,16 @@ func handleQueryV2(db *leveldb.DB, conn *net.UDPConn, addr *net.UDPAddr, buf []b
 
 		tb, err := ann.MarshalXDR()
 		if err != nil {
-			log.Println("QueryV2 response marshal:", err)
+			l.Warnln("QueryV2 response marshal:", err)
 			return nil
 		}
 		_, err = conn.WriteToUDP(tb, addr)
 		if err != nil {
-			log.Println("QueryV2 response write:", err)
+			l.Warnln("QueryV2 response write:", err)
 			return nil
 		}
 
-		lock.Lock()
-		answered++
-		lock.Unlock()
+		metrics.IncAnswered()
 	}
 	return nil
 }
@@ -319,131 +447,28 @@ func next(intv int) time.Time {
 }
 
 func logStats(statsLog io.Writer, intv int) {
+	var prev metrics.Snapshot
 	for {
 		t := next(intv)
 
-		lock.Lock()
-
+		cur := metrics.Load()
 		fmt.Fprintf(statsLog, "%d Queries:%d Answered:%d Announces:%d Unknown:%d Limited:%d\n",
-			t.Unix(), queries, answered, announces, unknowns, limited)
-
-		queries = 0
-		announces = 0
-		answered = 0
-		limited = 0
-		unknowns = 0
-
-		lock.Unlock()
-	}
-}
-
-func get(db *leveldb.DB, id protocol.DeviceID) ([]address, []relay) {
-	var addrs addressList
-	val, err := db.Get(id[:], nil)
-	if err == nil {
-		addrs.UnmarshalXDR(val)
-	}
-	return addrs.addresses, addrs.relays
-}
-
-func update(db *leveldb.DB, id protocol.DeviceID, addrs []address, relays []discover.Relay) {
-	var newAddrs addressList
-
-	val, err := db.Get(id[:], nil)
-	if err == nil {
-		newAddrs.UnmarshalXDR(val)
-	}
-
-nextAddr:
-	for _, newAddr := range addrs {
-		for i, exAddr := range newAddrs.addresses {
-			// If only the port has changed, replace the address in full,
-			// otherwise append it as a new address.
-			newAddrUri, err := url.Parse(newAddr.address)
-			if err != nil {
-				continue nextAddr
-			}
-			newAddrHost, _, err := net.SplitHostPort(newAddrUri.Host)
-			if err != nil {
-				continue nextAddr
-			}
-			newAddrUri.Host = net.JoinHostPort(newAddrHost, "22000")
-
-			exAddrUri, err := url.Parse(exAddr.address)
-			if err != nil {
-				continue
-			}
-			exAddrHost, _, err := net.SplitHostPort(exAddrUri.Host)
-			if err != nil {
-				continue
-			}
-			exAddrUri.Host = net.JoinHostPort(exAddrHost, "22000")
-
-			if exAddrUri.String() == newAddrUri.String() {
-				newAddrs.addresses[i] = newAddr
-				continue nextAddr
-			}
-		}
-		newAddrs.addresses = append(newAddrs.addresses, newAddr)
+			t.Unix(), cur.Queries-prev.Queries, cur.Answered-prev.Answered, cur.Announces-prev.Announces, cur.Unknowns-prev.Unknowns, cur.Limited-prev.Limited)
+		prev = cur
 	}
-
-	// Replace the relays with the latest
-	lrelays := make([]relay, 0, len(relays))
-	for _, rlay := range relays {
-		lrelays = append(lrelays, relay{
-			address: rlay.Address,
-			latency: rlay.Latency,
-		})
-	}
-	newAddrs.relays = lrelays
-
-	data, err := newAddrs.MarshalXDR()
-	if err != nil {
-		return
-	}
-	db.Put(id[:], data, nil)
 }
 
-func clean(statsLog io.Writer, db *leveldb.DB) {
+func clean(statsLog io.Writer, store Store) {
 	for {
 		now := next(cacheLimitSeconds)
-		nowSecs := now.Unix()
-
-		var kept, deleted int64
-		iter := db.NewIterator(nil, nil)
-		for iter.Next() {
-			var addrs addressList
-			addrs.UnmarshalXDR(iter.Value())
-
-			// Remove expired addresses
-			newAddrs := addrs.addresses
-			for i := 0; i < len(newAddrs); i++ {
-				if nowSecs-newAddrs[i].seen > cacheLimitSeconds {
-					newAddrs[i] = newAddrs[len(newAddrs)-1]
-					newAddrs = newAddrs[:len(newAddrs)-1]
-				}
-			}
 
-			// Delete empty records
-			if len(newAddrs) == 0 {
-				db.Delete(iter.Key(), nil)
-				deleted++
-				continue
-			}
-
-			// Update changed records
-			if len(newAddrs) != len(addrs.addresses) {
-				addrs.addresses = newAddrs
-				data, err := addrs.MarshalXDR()
-				if err != nil {
-					continue
-				}
-				db.Put(iter.Key(), data, nil)
-			}
-			kept++
+		kept, deleted, err := store.Clean(now)
+		if err != nil {
+			l.Warnln("Clean:", err)
+			continue
 		}
-		iter.Release()
+		l.Debugln("db", "Clean kept", kept, "deleted", deleted)
 
-		fmt.Fprintf(statsLog, "%d Kept:%d Deleted:%d Took:%0.04fs\n", nowSecs, kept, deleted, time.Since(now).Seconds())
+		fmt.Fprintf(statsLog, "%d Kept:%d Deleted:%d Took:%0.04fs\n", now.Unix(), kept, deleted, time.Since(now).Seconds())
 	}
 }
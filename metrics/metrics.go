@@ -0,0 +1,131 @@
+// Copyright (C) 2015 Audrius Butkevicius and Contributors (see the CONTRIBUTORS file).
+
+// Package metrics tracks discosrv's request counters, gauges and latency
+// histograms, and serves them in Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Request counters. These are cumulative for the lifetime of the process;
+// callers that want per-interval deltas (e.g. the stats file) should diff
+// successive calls to Load.
+var (
+	Queries   int64
+	Answered  int64
+	Announces int64
+	Unknowns  int64
+	Limited   int64
+)
+
+func IncQueries()   { atomic.AddInt64(&Queries, 1) }
+func IncAnswered()  { atomic.AddInt64(&Answered, 1) }
+func IncAnnounces() { atomic.AddInt64(&Announces, 1) }
+func IncUnknowns()  { atomic.AddInt64(&Unknowns, 1) }
+func IncLimited()   { atomic.AddInt64(&Limited, 1) }
+
+// Snapshot is a point-in-time read of the request counters.
+type Snapshot struct {
+	Queries, Answered, Announces, Unknowns, Limited int64
+}
+
+func Load() Snapshot {
+	return Snapshot{
+		Queries:   atomic.LoadInt64(&Queries),
+		Answered:  atomic.LoadInt64(&Answered),
+		Announces: atomic.LoadInt64(&Announces),
+		Unknowns:  atomic.LoadInt64(&Unknowns),
+		Limited:   atomic.LoadInt64(&Limited),
+	}
+}
+
+// Gauge is evaluated each time the metrics endpoint is scraped, so it can
+// report live state (LRU size, database row counts, ...) without needing
+// to be kept in sync eagerly.
+type Gauge func() float64
+
+var (
+	gaugesMut sync.Mutex
+	gauges    = make(map[string]Gauge)
+)
+
+// RegisterGauge adds a named gauge to be reported on every scrape.
+// Registering the same name twice replaces the previous gauge.
+func RegisterGauge(name string, fn Gauge) {
+	gaugesMut.Lock()
+	gauges[name] = fn
+	gaugesMut.Unlock()
+}
+
+// Histogram is a small, fixed-bucket latency histogram in the Prometheus
+// cumulative bucket style: each bucket counts observations less than or
+// equal to its upper bound.
+type Histogram struct {
+	buckets []float64 // upper bounds, in seconds
+	counts  []int64
+	sum     int64 // total observed duration, nanoseconds
+	total   int64
+}
+
+func NewHistogram(buckets ...float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	atomic.AddInt64(&h.sum, int64(d))
+	atomic.AddInt64(&h.total, 1)
+	secs := d.Seconds()
+	for i, b := range h.buckets {
+		if secs <= b {
+			atomic.AddInt64(&h.counts[i], 1)
+		}
+	}
+}
+
+var (
+	AnnounceLatency = NewHistogram(0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1)
+	QueryLatency    = NewHistogram(0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1)
+)
+
+// Handler serves the current counters, gauges and histograms in
+// Prometheus text exposition format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		snap := Load()
+		writeCounter(w, "discosrv_queries_total", snap.Queries)
+		writeCounter(w, "discosrv_answered_total", snap.Answered)
+		writeCounter(w, "discosrv_announces_total", snap.Announces)
+		writeCounter(w, "discosrv_unknowns_total", snap.Unknowns)
+		writeCounter(w, "discosrv_limited_total", snap.Limited)
+
+		gaugesMut.Lock()
+		for name, fn := range gauges {
+			fmt.Fprintf(w, "# TYPE %s gauge\n%s %v\n", name, name, fn())
+		}
+		gaugesMut.Unlock()
+
+		writeHistogram(w, "discosrv_announce_latency_seconds", AnnounceLatency)
+		writeHistogram(w, "discosrv_query_latency_seconds", QueryLatency)
+	})
+}
+
+func writeCounter(w http.ResponseWriter, name string, value int64) {
+	fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", name, name, value)
+}
+
+func writeHistogram(w http.ResponseWriter, name string, h *Histogram) {
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", name, b, atomic.LoadInt64(&h.counts[i]))
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, atomic.LoadInt64(&h.total))
+	fmt.Fprintf(w, "%s_sum %v\n", name, time.Duration(atomic.LoadInt64(&h.sum)).Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, atomic.LoadInt64(&h.total))
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2015 Audrius Butkevicius and Contributors (see the CONTRIBUTORS file).
+
+package main
+
+import (
+	"database/sql"
+
+	_ "github.com/lib/pq"
+)
+
+func init() {
+	register("postgres", postgresSetup, postgresCompile)
+}
+
+func postgresSetup(db *sql.DB) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS Devices (
+		DeviceID VARCHAR(64) NOT NULL PRIMARY KEY,
+		Seen TIMESTAMP NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS Addresses (
+		DeviceID VARCHAR(64) NOT NULL,
+		Seen TIMESTAMP NOT NULL DEFAULT now(),
+		Address VARCHAR(256) NOT NULL,
+		PRIMARY KEY (DeviceID, Address)
+	)`)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS Relays (
+		DeviceID VARCHAR(64) NOT NULL,
+		Seen TIMESTAMP NOT NULL DEFAULT now(),
+		Address VARCHAR(256) NOT NULL,
+		Latency INTEGER NOT NULL,
+		PRIMARY KEY (DeviceID, Address)
+	)`)
+	return
+}
+
+func postgresCompile(db *sql.DB) (map[string]*sql.Stmt, error) {
+	stmts := map[string]string{
+		"cleanAddress":  "DELETE FROM Addresses WHERE Seen < $1",
+		"cleanRelay":    "DELETE FROM Relays WHERE Seen < $1",
+		"cleanDevice":   "DELETE FROM Devices WHERE Seen < $1",
+		"countAddress":  "SELECT count(*) FROM Addresses",
+		"countDevice":   "SELECT count(*) FROM Devices",
+		"countRelay":    "SELECT count(*) FROM Relays",
+		"insertAddress": "INSERT INTO Addresses (DeviceID, Seen, Address) VALUES ($1, now(), $2) ON CONFLICT (DeviceID, Address) DO UPDATE SET Seen = now()",
+		"insertRelay":   "INSERT INTO Relays (DeviceID, Seen, Address, Latency) VALUES ($1, now(), $2, $3) ON CONFLICT (DeviceID, Address) DO UPDATE SET Seen = now(), Latency = $3",
+		"insertDevice":  "INSERT INTO Devices (DeviceID, Seen) VALUES ($1, now()) ON CONFLICT (DeviceID) DO UPDATE SET Seen = now()",
+		"selectAddress": `SELECT Address FROM Addresses WHERE DeviceID = $1 AND Seen > now() - interval '1 hour' LIMIT 16`,
+		"selectRelay":   `SELECT Address, Latency FROM Relays WHERE DeviceID = $1 AND Seen > now() - interval '1 hour' LIMIT 16`,
+		"updateAddress": "UPDATE Addresses SET Seen = now() WHERE DeviceID = $1 AND Address = $2",
+		"updateDevice":  "UPDATE Devices SET Seen = now() WHERE DeviceID = $1",
+		"deleteRelay":   "DELETE FROM Relays WHERE DeviceID = $1",
+	}
+
+	res := make(map[string]*sql.Stmt, len(stmts))
+	for key, stmt := range stmts {
+		prep, err := db.Prepare(stmt)
+		if err != nil {
+			l.Warnln("Failed to compile", stmt, err)
+			return nil, err
+		}
+		res[key] = prep
+	}
+	return res, nil
+}
@@ -4,7 +4,6 @@ package main
 
 import (
 	"database/sql"
-	"log"
 
 	"github.com/cznic/ql"
 )
@@ -69,9 +68,9 @@ func qlSetup(db *sql.DB) (err error) {
 
 func qlCompile(db *sql.DB) (map[string]*sql.Stmt, error) {
 	stmts := map[string]string{
-		"cleanAddress":  `DELETE FROM Addresses WHERE Seen < now() - duration("2h")`,
-		"cleanRelay":    `DELETE FROM Relays WHERE Seen < now() - duration("2h")`,
-		"cleanDevice":   `DELETE FROM Devices WHERE Seen < now() - duration("24h")`,
+		"cleanAddress":  "DELETE FROM Addresses WHERE Seen < $1",
+		"cleanRelay":    "DELETE FROM Relays WHERE Seen < $1",
+		"cleanDevice":   "DELETE FROM Devices WHERE Seen < $1",
 		"countAddress":  "SELECT count(*) FROM Addresses",
 		"countDevice":   "SELECT count(*) FROM Devices",
 		"countRelay":    "SELECT count(*) FROM Relays",
@@ -89,7 +88,7 @@ func qlCompile(db *sql.DB) (map[string]*sql.Stmt, error) {
 	for key, stmt := range stmts {
 		prep, err := db.Prepare(stmt)
 		if err != nil {
-			log.Println("Failed to compile", stmt)
+			l.Warnln("Failed to compile", stmt, err)
 			return nil, err
 		}
 		res[key] = prep
@@ -0,0 +1,116 @@
+// Copyright (C) 2015 Audrius Butkevicius and Contributors (see the CONTRIBUTORS file).
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// rotator is an io.Writer over a named file that rotates the file once it
+// reaches maxSize bytes (if maxSize > 0). The current file is renamed to
+// <path>.NNN, using the first free slot in [1, 999], and a fresh file is
+// opened in its place. Age based rotation is driven externally by calling
+// Rotate, since the interval is governed by the caller's own ticker.
+type rotator struct {
+	path    string
+	maxSize int64
+
+	mut  sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newRotator(path string, maxSize int64) (*rotator, error) {
+	r := &rotator{path: path, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotator) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = fi.Size()
+	return nil
+}
+
+func (r *rotator) Write(p []byte) (int, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	if r.maxSize > 0 && r.size >= r.maxSize {
+		if err := r.rotateLocked(); err != nil {
+			l.Warnln("Log rotate:", err)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Rotate forces rotation regardless of the current size, for use by
+// callers implementing time based rotation on their own ticker.
+func (r *rotator) Rotate() error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.rotateLocked()
+}
+
+func (r *rotator) rotateLocked() error {
+	// Find the destination slot before closing the current file, so a
+	// full rotation namespace (or any other lookup failure) leaves the
+	// existing file open and Write keeps appending to it.
+	slot, err := nextRotationSlot(r.path)
+	if err != nil {
+		return err
+	}
+
+	r.file.Close()
+
+	if err := os.Rename(r.path, fmt.Sprintf("%s.%03d", r.path, slot)); err != nil {
+		// The rename failed, so the original file is still at r.path;
+		// reopen it rather than leaving r.file pointing at a closed
+		// descriptor, which would fail every subsequent write.
+		if openErr := r.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+
+	return r.open()
+}
+
+// nextRotationSlot finds the first unused ".NNN" suffix for path, from
+// .001 to .999.
+func nextRotationSlot(path string) (int, error) {
+	for slot := 1; slot <= 999; slot++ {
+		if _, err := os.Stat(fmt.Sprintf("%s.%03d", path, slot)); os.IsNotExist(err) {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: no free rotation slot up to 999", path)
+}
+
+// watchRotateAge calls r.Rotate every maxAge, using the same next()
+// ticker as the periodic stats and cleanup loops.
+func watchRotateAge(r *rotator, maxAge time.Duration) {
+	for {
+		next(int(maxAge.Seconds()))
+		if err := r.Rotate(); err != nil {
+			l.Warnln("Log rotate:", err)
+		}
+	}
+}
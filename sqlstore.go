@@ -0,0 +1,183 @@
+// Copyright (C) 2015 Audrius Butkevicius and Contributors (see the CONTRIBUTORS file).
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/lib/discover"
+)
+
+// dbSetupFunc creates the schema for a database backend, if it doesn't
+// already exist.
+type dbSetupFunc func(*sql.DB) error
+
+// dbCompileFunc prepares the statements a backend needs, keyed by the
+// names used in sqlStore.
+type dbCompileFunc func(*sql.DB) (map[string]*sql.Stmt, error)
+
+type dbBackend struct {
+	driver  string
+	setup   dbSetupFunc
+	compile dbCompileFunc
+}
+
+var backends = make(map[string]dbBackend)
+
+// register adds a database backend under the given name, to be selected
+// with -db-backend. name is also the database/sql driver name passed to
+// sql.Open.
+func register(name string, setup dbSetupFunc, compile dbCompileFunc) {
+	backends[name] = dbBackend{driver: name, setup: setup, compile: compile}
+}
+
+// sqlStore implements Store on top of any backend registered with
+// register, using the common Devices/Addresses/Relays schema shared by
+// the ql and postgres backends. addressMaxAge and deviceMaxAge are the
+// retention windows applied by Clean, configurable via -address-max-age
+// and -device-max-age.
+type sqlStore struct {
+	db            *sql.DB
+	stmts         map[string]*sql.Stmt
+	addressMaxAge time.Duration
+	deviceMaxAge  time.Duration
+}
+
+func newSQLStore(name, dsn string, addressMaxAge, deviceMaxAge time.Duration) (*sqlStore, error) {
+	backend, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown database backend %q", name)
+	}
+
+	db, err := sql.Open(backend.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := backend.setup(db); err != nil {
+		return nil, err
+	}
+
+	stmts, err := backend.compile(db)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Debugln("db", "Opened", name, "store")
+
+	return &sqlStore{db: db, stmts: stmts, addressMaxAge: addressMaxAge, deviceMaxAge: deviceMaxAge}, nil
+}
+
+func (s *sqlStore) Get(id protocol.DeviceID) ([]address, []relay, error) {
+	idStr := id.String()
+
+	var addrs []address
+	rows, err := s.stmts["selectAddress"].Query(idStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var a address
+		if err := rows.Scan(&a.address); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		a.seen = time.Now().Unix()
+		addrs = append(addrs, a)
+	}
+	rows.Close()
+
+	var relays []relay
+	rows, err = s.stmts["selectRelay"].Query(idStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var r relay
+		if err := rows.Scan(&r.address, &r.latency); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		relays = append(relays, r)
+	}
+	rows.Close()
+
+	return addrs, relays, nil
+}
+
+func (s *sqlStore) Update(id protocol.DeviceID, addrs []address, relays []discover.Relay) error {
+	idStr := id.String()
+
+	if res, err := s.stmts["updateDevice"].Exec(idStr); err != nil {
+		return err
+	} else if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := s.stmts["insertDevice"].Exec(idStr); err != nil {
+			return err
+		}
+	}
+
+	for _, a := range addrs {
+		if res, err := s.stmts["updateAddress"].Exec(idStr, a.address); err != nil {
+			return err
+		} else if n, _ := res.RowsAffected(); n == 0 {
+			if _, err := s.stmts["insertAddress"].Exec(idStr, a.address); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := s.stmts["deleteRelay"].Exec(idStr); err != nil {
+		return err
+	}
+	for _, r := range relays {
+		if _, err := s.stmts["insertRelay"].Exec(idStr, r.Address, r.Latency); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlStore) Clean(cutoff time.Time) (kept, deleted int64, err error) {
+	addressCutoff := cutoff.Add(-s.addressMaxAge)
+
+	res, err := s.stmts["cleanAddress"].Exec(addressCutoff)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, _ := res.RowsAffected()
+	deleted += n
+
+	if _, err := s.stmts["cleanRelay"].Exec(addressCutoff); err != nil {
+		return 0, 0, err
+	}
+
+	res, err = s.stmts["cleanDevice"].Exec(cutoff.Add(-s.deviceMaxAge))
+	if err != nil {
+		return 0, 0, err
+	}
+	n, _ = res.RowsAffected()
+	deleted += n
+
+	var count int64
+	row := s.stmts["countDevice"].QueryRow()
+	if err := row.Scan(&count); err != nil {
+		return 0, deleted, err
+	}
+
+	return count, deleted, nil
+}
+
+func (s *sqlStore) Counts() (devices, addresses, relays int64, err error) {
+	if err = s.stmts["countDevice"].QueryRow().Scan(&devices); err != nil {
+		return
+	}
+	if err = s.stmts["countAddress"].QueryRow().Scan(&addresses); err != nil {
+		return
+	}
+	err = s.stmts["countRelay"].QueryRow().Scan(&relays)
+	return
+}
@@ -0,0 +1,159 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+
+package main
+
+import (
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/lib/discover"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// Store is the persistence layer used by both the UDP and HTTP discovery
+// frontends. The backend is selected at startup via the -db-backend flag:
+// "leveldb" is built in, and SQL backends are registered by name (see
+// register).
+type Store interface {
+	Get(id protocol.DeviceID) ([]address, []relay, error)
+	Update(id protocol.DeviceID, addrs []address, relays []discover.Relay) error
+	Clean(cutoff time.Time) (kept, deleted int64, err error)
+	Counts() (devices, addresses, relays int64, err error)
+}
+
+// leveldbStore is the original, default backend. It keeps one XDR-encoded
+// addressList per device, keyed on the raw device ID.
+type leveldbStore struct {
+	db *leveldb.DB
+}
+
+func newLeveldbStore(dir string) (*leveldbStore, error) {
+	db, err := leveldb.OpenFile(dir, &opt.Options{OpenFilesCacheCapacity: 32})
+	if err != nil {
+		return nil, err
+	}
+	l.Debugln("db", "Opened leveldb store at", dir)
+	return &leveldbStore{db: db}, nil
+}
+
+func (s *leveldbStore) Get(id protocol.DeviceID) ([]address, []relay, error) {
+	var addrs addressList
+	val, err := s.db.Get(id[:], nil)
+	if err == nil {
+		addrs.UnmarshalXDR(val)
+	}
+	return addrs.addresses, addrs.relays, nil
+}
+
+func (s *leveldbStore) Update(id protocol.DeviceID, addrs []address, relays []discover.Relay) error {
+	var newAddrs addressList
+
+	val, err := s.db.Get(id[:], nil)
+	if err == nil {
+		newAddrs.UnmarshalXDR(val)
+	}
+
+nextAddr:
+	for _, newAddr := range addrs {
+		for i, exAddr := range newAddrs.addresses {
+			// If only the port has changed, replace the address in full,
+			// otherwise append it as a new address.
+			newAddrUri, err := url.Parse(newAddr.address)
+			if err != nil {
+				continue nextAddr
+			}
+			newAddrHost, _, err := net.SplitHostPort(newAddrUri.Host)
+			if err != nil {
+				continue nextAddr
+			}
+			newAddrUri.Host = net.JoinHostPort(newAddrHost, "22000")
+
+			exAddrUri, err := url.Parse(exAddr.address)
+			if err != nil {
+				continue
+			}
+			exAddrHost, _, err := net.SplitHostPort(exAddrUri.Host)
+			if err != nil {
+				continue
+			}
+			exAddrUri.Host = net.JoinHostPort(exAddrHost, "22000")
+
+			if exAddrUri.String() == newAddrUri.String() {
+				newAddrs.addresses[i] = newAddr
+				continue nextAddr
+			}
+		}
+		newAddrs.addresses = append(newAddrs.addresses, newAddr)
+	}
+
+	// Replace the relays with the latest
+	lrelays := make([]relay, 0, len(relays))
+	for _, rlay := range relays {
+		lrelays = append(lrelays, relay{
+			address: rlay.Address,
+			latency: rlay.Latency,
+		})
+	}
+	newAddrs.relays = lrelays
+
+	data, err := newAddrs.MarshalXDR()
+	if err != nil {
+		return err
+	}
+	return s.db.Put(id[:], data, nil)
+}
+
+func (s *leveldbStore) Clean(cutoff time.Time) (kept, deleted int64, err error) {
+	cutoffSecs := cutoff.Unix()
+
+	iter := s.db.NewIterator(nil, nil)
+	for iter.Next() {
+		var addrs addressList
+		addrs.UnmarshalXDR(iter.Value())
+
+		// Remove expired addresses
+		newAddrs := addrs.addresses
+		for i := 0; i < len(newAddrs); i++ {
+			if cutoffSecs-newAddrs[i].seen > cacheLimitSeconds {
+				newAddrs[i] = newAddrs[len(newAddrs)-1]
+				newAddrs = newAddrs[:len(newAddrs)-1]
+			}
+		}
+
+		// Delete empty records
+		if len(newAddrs) == 0 {
+			s.db.Delete(iter.Key(), nil)
+			deleted++
+			continue
+		}
+
+		// Update changed records
+		if len(newAddrs) != len(addrs.addresses) {
+			addrs.addresses = newAddrs
+			data, err := addrs.MarshalXDR()
+			if err == nil {
+				s.db.Put(iter.Key(), data, nil)
+			}
+		}
+		kept++
+	}
+	iter.Release()
+
+	return kept, deleted, nil
+}
+
+func (s *leveldbStore) Counts() (devices, addresses, relays int64, err error) {
+	iter := s.db.NewIterator(nil, nil)
+	for iter.Next() {
+		var addrs addressList
+		addrs.UnmarshalXDR(iter.Value())
+		devices++
+		addresses += int64(len(addrs.addresses))
+		relays += int64(len(addrs.relays))
+	}
+	iter.Release()
+	return devices, addresses, relays, nil
+}